@@ -1,6 +1,7 @@
 package eio
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/jjeffcaii/engine.io/parser"
@@ -33,8 +34,12 @@ type Engine interface {
 	CountClients() int
 	// OnConnect bind handler when sockets created.
 	OnConnect(func(socket Socket)) Engine
-	// Close current engine server.
+	// Close current engine server and all sockets immediately.
 	Close()
+	// Shutdown current engine server gracefully.
+	// It stops accepting new sockets, sends close packet to every socket and waits for them to be flushed.
+	// Rest sockets will be closed forcibly and ctx.Err() will be returned if ctx is done before that.
+	Shutdown(ctx context.Context) error
 }
 
 // Transport is used to control socket.
@@ -60,6 +65,8 @@ type Transport interface {
 	write(packet *parser.Packet) error
 	flush() error
 	close() error
+	// returns amount of packets waiting to be sent.
+	pending() int
 }
 
 // Socket is a representation of a client.
@@ -73,13 +80,26 @@ type Socket interface {
 	// OnClose bind handler when socket closed.
 	OnClose(func(reason string)) Socket
 	// OnMessage bind handler when message income.
+	// Binary messages are also dispatched here if no binary handler is bound.
 	OnMessage(func(data []byte)) Socket
+	// OnBinary bind handler when binary message income.
+	OnBinary(func(data []byte)) Socket
 	// OnError bind handler when error appeared.
 	OnError(func(err error)) Socket
 	// OnUpgrade bind handler when socket upgraded.
 	OnUpgrade(func()) Socket
 	// Send a message.
 	Send(message interface{}) error
+	// SendBinary send a binary message.
+	SendBinary(data []byte) error
+	// Set bind a value with key to current socket. Values will be dropped after socket closed.
+	Set(key string, value interface{})
+	// Get returns the value bind with key.
+	Get(key string) (interface{}, bool)
+	// Delete remove the value bind with key.
+	Delete(key string)
+	// Keys returns all keys of values bind to current socket.
+	Keys() []string
 	// Close current socket.
 	Close()
 }
@@ -1,6 +1,7 @@
 package eio
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -9,8 +10,11 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
 )
 
+const shutdownPollInterval = 50 * time.Millisecond
+
 var (
 	protocolVersion = struct {
 		n uint8
@@ -25,6 +29,7 @@ type engineOptions struct {
 	cookieHTTPOnly bool
 	pingInterval   uint32
 	pingTimeout    uint32
+	checkOrigin    func(*http.Request) bool
 }
 
 type engineImpl struct {
@@ -34,15 +39,25 @@ type engineImpl struct {
 	path            string
 	options         *engineOptions
 	onSockets       []func(Socket)
+	authenticate    func(*http.Request) error
 	sockets         *socketMap
 	junkKiller      chan struct{}
 	junkTicker      *time.Ticker
+	closeOnce       *sync.Once
+	shutdown        bool
+	handshakeLock   *sync.RWMutex
+	upgrader        *websocket.Upgrader
 }
 
 func (p *engineImpl) Router() func(http.ResponseWriter, *http.Request) {
-	p.ensureCleaner()
 	return func(writer http.ResponseWriter, request *http.Request) {
+		// check origin
+		if !p.options.checkOrigin(request) {
+			sendError(writer, fmt.Errorf("origin '%s' is forbidden", request.Header.Get("Origin")), http.StatusForbidden)
+			return
+		}
 		if request.Method == http.MethodOptions {
+			setAllowOrigin(writer, request)
 			writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 			writer.WriteHeader(http.StatusOK)
 			return
@@ -73,18 +88,9 @@ func (p *engineImpl) Router() func(http.ResponseWriter, *http.Request) {
 		var transportActive Transport
 
 		if isNew {
-			sid = p.generateID()
-			transportActive, socketActive = newTransport(p, tTypeActive), newSocket(sid, p)
-			socketActive.setTransport(transportActive)
-			transportActive.setSocket(socketActive)
-			if err = transportActive.init(writer, request); err != nil {
-				sendError(writer, err)
+			if socketActive, transportActive = p.handshake(writer, request, tTypeActive); socketActive == nil {
 				return
 			}
-			socketActive.OnClose(func(reason string) {
-				p.sockets.Remove(socketActive)
-			})
-			p.sockets.Put(socketActive)
 			p.socketCreated(socketActive)
 		} else if socketOld, ok := p.sockets.Get(sid); !ok {
 			sendError(writer, fmt.Errorf("%s:socketActive#%s doesn't exist", request.Method, sid))
@@ -96,9 +102,21 @@ func (p *engineImpl) Router() func(http.ResponseWriter, *http.Request) {
 			if tTypeActive > tTypeOld {
 				transportActive = newTransport(p, tTypeActive)
 				transportActive.setSocket(socketActive)
-				socketActive.setTransport(transportActive)
+				if err = socketActive.setTransport(transportActive); err != nil {
+					sendError(writer, fmt.Errorf("%s:socket#%s is upgrading already", request.Method, sid), http.StatusBadRequest)
+					return
+				}
 			} else if tTypeActive < tTypeOld {
-				transportActive = socketOld.getTransportBackup()
+				var ok bool
+				if transportActive, ok = socketOld.tryTransportBackup(); !ok {
+					// old transport has been closed after upgrade.
+					sendError(writer, fmt.Errorf("%s:socket#%s has been upgraded", request.Method, sid), http.StatusBadRequest)
+					return
+				}
+			} else if tTypeActive == WEBSOCKET {
+				// websocket connection can't be shared.
+				sendError(writer, fmt.Errorf("%s:socket#%s has a websocket already", request.Method, sid), http.StatusBadRequest)
+				return
 			} else {
 				transportActive = transportOld
 			}
@@ -107,8 +125,100 @@ func (p *engineImpl) Router() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
+// handshake create and register a new socket, returns nil if failed.
+func (p *engineImpl) handshake(writer http.ResponseWriter, request *http.Request, tType TransportType) (*socketImpl, Transport) {
+	errShutdown := errors.New("server is shutting down")
+	if p.isShutdown() {
+		sendError(writer, errShutdown, http.StatusServiceUnavailable)
+		return nil, nil
+	}
+	// authenticate handshake before any socket created.
+	if p.authenticate != nil {
+		if err := p.authenticate(request); err != nil {
+			sendError(writer, err, http.StatusUnauthorized)
+			return nil, nil
+		}
+	}
+	transport, socket := newTransport(p, tType), newSocket(p.generateID(), p)
+	socket.setTransport(transport)
+	transport.setSocket(socket)
+	if err := transport.init(writer, request); err != nil {
+		sendError(writer, err)
+		return nil, nil
+	}
+	// shutdown may start during handshake, check again before socket registered.
+	p.handshakeLock.RLock()
+	shutdown := p.shutdown
+	if !shutdown {
+		p.sockets.Put(socket)
+	}
+	p.handshakeLock.RUnlock()
+	if shutdown {
+		socket.close("server shutdown")
+		// websocket response has been sent by upgrade.
+		if tType == POLLING {
+			sendError(writer, errShutdown, http.StatusServiceUnavailable)
+		}
+		return nil, nil
+	}
+	return socket, transport
+}
+
+func (p *engineImpl) isShutdown() bool {
+	p.handshakeLock.RLock()
+	defer p.handshakeLock.RUnlock()
+	return p.shutdown
+}
+
+// stopHandshake reject new sockets, sockets registered before are visible after it returns.
+func (p *engineImpl) stopHandshake() {
+	p.handshakeLock.Lock()
+	p.shutdown = true
+	p.handshakeLock.Unlock()
+}
+
 func (p *engineImpl) Close() {
-	close(p.junkKiller)
+	p.stopHandshake()
+	p.stopCleaner()
+	for _, it := range p.sockets.List(nil) {
+		it.close("forced close")
+	}
+}
+
+func (p *engineImpl) Shutdown(ctx context.Context) error {
+	p.stopHandshake()
+	p.stopCleaner()
+	sockets := p.sockets.List(nil)
+	for _, it := range sockets {
+		if err := it.write(defaultPacketClose); err != nil {
+			glog.Warningf("send close packet to socket#%s failed: %s\n", it.ID(), err)
+		}
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for len(sockets) > 0 {
+		rest := make([]*socketImpl, 0)
+		for _, it := range sockets {
+			if it.isDrained() {
+				it.close("server shutdown")
+			} else {
+				rest = append(rest, it)
+			}
+		}
+		sockets = rest
+		if len(sockets) < 1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			p.Close()
+			return ctx.Err()
+		case <-ticker.C:
+			break
+		}
+	}
+	p.Close()
+	return nil
 }
 
 func (p *engineImpl) Listen(addr string) error {
@@ -149,9 +259,9 @@ func (p *engineImpl) checkTransport(qTransport string) (TransportType, error) {
 	switch qTransport {
 	default:
 		return -1, fmt.Errorf("invalid transport '%s'", qTransport)
-	case "polling":
+	case transportPolling:
 		t = POLLING
-	case "websocket":
+	case transportWebsocket:
 		t = WEBSOCKET
 	}
 	for _, it := range p.allowTransports {
@@ -169,22 +279,20 @@ func (p *engineImpl) generateID() string {
 	return p.sidGen(atomic.AddUint32(&(p.sequence), 1))
 }
 
-func (p *engineImpl) ensureCleaner() {
-	if p.junkTicker != nil {
-		return
-	}
-	p.junkTicker = time.NewTicker(time.Millisecond * time.Duration(p.options.pingTimeout))
+func (p *engineImpl) startCleaner() {
+	p.junkTicker = time.NewTicker(time.Millisecond * time.Duration(p.options.pingInterval))
 	// cron: check and kill lost socket.
 	go func() {
 		for {
 			select {
 			case <-p.junkTicker.C:
+				// sockets in upgrading will be checked in next round.
 				losts := p.sockets.List(func(val *socketImpl) bool {
-					return val.isLost()
+					return !val.isUpgrading() && val.isLost()
 				})
 				if len(losts) > 0 {
 					for _, it := range losts {
-						it.Close()
+						it.close("ping timeout")
 					}
 					glog.Infof("***** kill %d DEAD sockets *****\n", len(losts))
 				}
@@ -197,6 +305,12 @@ func (p *engineImpl) ensureCleaner() {
 	}()
 }
 
+func (p *engineImpl) stopCleaner() {
+	p.closeOnce.Do(func() {
+		close(p.junkKiller)
+	})
+}
+
 func (p *engineImpl) socketCreated(socket *socketImpl) {
 	if p.onSockets == nil {
 		return
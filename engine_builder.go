@@ -3,6 +3,7 @@ package eio
 import (
 	"errors"
 	"math/rand"
+	"net/http"
 	"sync"
 )
 
@@ -13,12 +14,16 @@ const (
 
 var defaultTransports = []TransportType{POLLING, WEBSOCKET}
 
+// allowAnyOrigin is the default origin policy for backward compatibility.
+func allowAnyOrigin(_ *http.Request) bool { return true }
+
 // EngineBuilder is a builder for Engine.
 type EngineBuilder struct {
 	allowTransports []TransportType
 	options         *engineOptions
 	path            string
 	gen             func(uint32) string
+	authenticate    func(*http.Request) error
 }
 
 // SetTransports define transport types allow.
@@ -73,16 +78,63 @@ func (p *EngineBuilder) SetAllowUpgrades(enable bool) *EngineBuilder {
 
 // SetPingInterval define ping time interval in millseconds for client.
 func (p *EngineBuilder) SetPingInterval(interval uint32) *EngineBuilder {
+	if interval < 1 {
+		panic(errors.New("invalid ping interval: interval must be positive"))
+	}
 	p.options.pingInterval = interval
 	return p
 }
 
 // SetPingTimeout define ping timeout in millseconds for client.
+// Socket will be closed if no ping received in pingInterval + pingTimeout.
 func (p *EngineBuilder) SetPingTimeout(timeout uint32) *EngineBuilder {
+	if timeout < 1 {
+		panic(errors.New("invalid ping timeout: timeout must be positive"))
+	}
 	p.options.pingTimeout = timeout
 	return p
 }
 
+// SetAllowOrigins define origins allowed to connect, "*" means any origin.
+// Requests without Origin header are always allowed. (default allow any origin)
+// It shares the same setting with SetCheckOrigin, whichever is called last wins.
+func (p *EngineBuilder) SetAllowOrigins(origins ...string) *EngineBuilder {
+	allows := make([]string, len(origins))
+	copy(allows, origins)
+	p.options.checkOrigin = func(request *http.Request) bool {
+		origin := request.Header.Get("Origin")
+		if len(origin) < 1 {
+			return true
+		}
+		for _, it := range allows {
+			if it == "*" || it == origin {
+				return true
+			}
+		}
+		return false
+	}
+	return p
+}
+
+// SetCheckOrigin define a custom method to check origin of requests.
+// It shares the same setting with SetAllowOrigins, whichever is called last wins.
+// Both websocket upgrade and polling requests will be rejected with 403 if it returns false.
+// (default allow any origin)
+func (p *EngineBuilder) SetCheckOrigin(checkOrigin func(*http.Request) bool) *EngineBuilder {
+	if checkOrigin == nil {
+		panic(errors.New("invalid check origin: method is nil"))
+	}
+	p.options.checkOrigin = checkOrigin
+	return p
+}
+
+// OnAuthenticate define a handler to validate the handshake request of new socket.
+// Connection will be rejected with 401 if handler returns an error.
+func (p *EngineBuilder) OnAuthenticate(handler func(*http.Request) error) *EngineBuilder {
+	p.authenticate = handler
+	return p
+}
+
 // Build returns a new Engine.
 func (p *EngineBuilder) Build() Engine {
 	clone := func(origin engineOptions) engineOptions {
@@ -92,22 +144,27 @@ func (p *EngineBuilder) Build() Engine {
 		store: new(sync.Map),
 	}
 	eng := &engineImpl{
-		sequence:   rand.Uint32(),
-		onSockets:  make([]func(Socket), 0),
-		options:    &clone,
-		sockets:    &sockets,
-		path:       p.path,
-		sidGen:     p.gen,
-		junkKiller: make(chan struct{}),
-		junkTicker: nil,
+		sequence:      rand.Uint32(),
+		onSockets:     make([]func(Socket), 0),
+		options:       &clone,
+		sockets:       &sockets,
+		path:          p.path,
+		sidGen:        p.gen,
+		authenticate:  p.authenticate,
+		upgrader:      newWebsocketUpgrader(clone.checkOrigin),
+		junkKiller:    make(chan struct{}),
+		junkTicker:    nil,
+		closeOnce:     new(sync.Once),
+		handshakeLock: new(sync.RWMutex),
 	}
 	if len(p.allowTransports) < 1 {
 		eng.allowTransports = defaultTransports
 	} else {
-		allows := make([]TransportType, 0)
+		allows := make([]TransportType, len(p.allowTransports))
 		copy(allows, p.allowTransports)
 		eng.allowTransports = allows
 	}
+	eng.startCleaner()
 	return eng
 }
 
@@ -120,6 +177,7 @@ func NewEngineBuilder() *EngineBuilder {
 		pingInterval:   defaultPingInterval,
 		pingTimeout:    defaultPingTimeout,
 		allowUpgrades:  true,
+		checkOrigin:    allowAnyOrigin,
 	}
 	builder := EngineBuilder{
 		path:    DefaultPath,
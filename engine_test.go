@@ -1,8 +1,20 @@
 package eio
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jjeffcaii/engine.io/parser"
 )
 
 var server Engine
@@ -17,3 +29,597 @@ func TestFunction(t *testing.T) {
 	t.Log("PASS")
 
 }
+
+func pollingGet(t *testing.T, url string) []*parser.Packet {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("bad status %d: %s", res.StatusCode, body)
+	}
+	packets, err := parser.DecodePayload(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packets
+}
+
+func pollingHandshake(t *testing.T, baseURL string, params ...string) messageOK {
+	url := baseURL + "/engine.io/?EIO=3&transport=polling"
+	for _, it := range params {
+		url += "&" + it
+	}
+	packets := pollingGet(t, url)
+	if len(packets) != 1 || packets[0].Type != parser.OPEN {
+		t.Fatal("should receive an open packet")
+	}
+	var msg messageOK
+	if err := json.Unmarshal(packets[0].Data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPollingHandshake(t *testing.T) {
+	eng := NewEngineBuilder().SetPingTimeout(3000).SetPingInterval(200).Build()
+	defer eng.Close()
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	if strings.Join(msg.Upgrades, ",") != "polling,websocket" {
+		t.Error("bad upgrades:", msg.Upgrades)
+	}
+	if eng.CountClients() != 1 {
+		t.Error("should have 1 client")
+	}
+
+	// nothing to send: polling should be finished by a noop packet after ping interval.
+	packets := pollingGet(t, ts.URL+"/engine.io/?EIO=3&transport=polling&sid="+msg.Sid)
+	if len(packets) != 1 || packets[0].Type != parser.NOOP {
+		t.Error("should receive a noop packet")
+	}
+	if eng.CountClients() != 1 {
+		t.Error("socket should be alive after noop")
+	}
+}
+
+func TestPollingPostMessage(t *testing.T) {
+	eng := NewEngineBuilder().SetPingInterval(200).Build()
+	defer eng.Close()
+	received := make(chan string, 1)
+	eng.OnConnect(func(socket Socket) {
+		socket.OnMessage(func(data []byte) {
+			received <- string(data)
+			socket.Send("[ECHO] " + string(data))
+		})
+	})
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	url := ts.URL + "/engine.io/?EIO=3&transport=polling&sid=" + msg.Sid
+	res, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader("6:4hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := <-received; got != "hello" {
+		t.Error("bad message:", got)
+	}
+	packets := pollingGet(t, url)
+	if len(packets) != 1 || string(packets[0].Data) != "[ECHO] hello" {
+		t.Error("should receive echo message")
+	}
+}
+
+func TestPollingPostMalformed(t *testing.T) {
+	eng := NewEngineBuilder().Build()
+	defer eng.Close()
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	url := ts.URL + "/engine.io/?EIO=3&transport=polling&sid=" + msg.Sid
+	res, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader("99:4hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("malformed payload should be rejected with 400, got", res.StatusCode)
+	}
+}
+
+func TestPollingBinary(t *testing.T) {
+	eng := NewEngineBuilder().SetPingInterval(200).Build()
+	defer eng.Close()
+	blob := []byte{0x00, 0xFF, 0x80, 0x0A, 0xC3}
+	texts, bins := make(chan []byte, 1), make(chan []byte, 1)
+	eng.OnConnect(func(socket Socket) {
+		socket.OnMessage(func(data []byte) {
+			texts <- data
+		})
+		socket.OnBinary(func(data []byte) {
+			bins <- data
+			socket.SendBinary(data)
+		})
+	})
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	url := ts.URL + "/engine.io/?EIO=3&transport=polling&sid=" + msg.Sid
+	payload, err := parser.EncodePayload(parser.NewPacketCustom(parser.MESSAGE, blob, parser.BINARY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(url, "text/plain;charset=UTF-8", strings.NewReader(string(payload)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := <-bins; string(got) != string(blob) {
+		t.Error("bad binary message:", got)
+	}
+	select {
+	case <-texts:
+		t.Error("binary message should not be dispatched to message handlers")
+	default:
+	}
+	packets := pollingGet(t, url)
+	if len(packets) != 1 || packets[0].Option&parser.BINARY != parser.BINARY || string(packets[0].Data) != string(blob) {
+		t.Error("should receive binary echo")
+	}
+}
+
+func TestWebsocketBinary(t *testing.T) {
+	eng := NewEngineBuilder().Build()
+	defer eng.Close()
+	blob := []byte{0x00, 0xFF, 0x80, 0x0A, 0xC3}
+	texts, bins := make(chan []byte, 1), make(chan []byte, 1)
+	eng.OnConnect(func(socket Socket) {
+		socket.OnMessage(func(data []byte) {
+			texts <- data
+		})
+		socket.OnBinary(func(data []byte) {
+			bins <- data
+			socket.SendBinary(data)
+		})
+	})
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/engine.io/?EIO=3&transport=websocket"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, bs, err := conn.ReadMessage(); err != nil || len(bs) < 1 || bs[0] != '0' {
+		t.Fatal("should receive an open packet")
+	}
+
+	// binary frame: packet type byte then raw data.
+	if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte{byte(parser.MESSAGE)}, blob...)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-bins; string(got) != string(blob) {
+		t.Error("bad binary message:", got)
+	}
+	select {
+	case <-texts:
+		t.Error("binary message should not be dispatched to message handlers")
+	default:
+	}
+	msgType, bs, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != websocket.BinaryMessage {
+		t.Error("SendBinary should be sent as binary message")
+	}
+	if len(bs) < 1 || bs[0] != byte(parser.MESSAGE) || string(bs[1:]) != string(blob) {
+		t.Error("bad binary echo:", bs)
+	}
+
+	// text frames still go to message handlers.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("4hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-texts; string(got) != "hello" {
+		t.Error("bad text message:", string(got))
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	var auths int
+	eng := NewEngineBuilder().SetPingInterval(200).OnAuthenticate(func(req *http.Request) error {
+		auths++
+		if req.URL.Query().Get("token") != "secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}).Build()
+	defer eng.Close()
+	var connects int
+	eng.OnConnect(func(socket Socket) {
+		connects++
+	})
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/engine.io/?EIO=3&transport=polling&token=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Error("should be rejected with 401, got", res.StatusCode)
+	}
+	if eng.CountClients() != 0 || connects != 0 {
+		t.Error("rejected handshake should not create socket")
+	}
+
+	msg := pollingHandshake(t, ts.URL, "token=secret")
+	pollingGet(t, ts.URL+"/engine.io/?EIO=3&transport=polling&sid="+msg.Sid)
+	if auths != 2 {
+		t.Error("authenticate should only run for new sid, got", auths)
+	}
+	if eng.CountClients() != 1 || connects != 1 {
+		t.Error("should have 1 client")
+	}
+}
+
+func TestAllowOrigins(t *testing.T) {
+	eng := NewEngineBuilder().SetPingInterval(200).SetAllowOrigins("http://good.example.com").Build()
+	defer eng.Close()
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	url := ts.URL + "/engine.io/?EIO=3&transport=polling"
+	for origin, code := range map[string]int{
+		"http://good.example.com": http.StatusOK,
+		"http://evil.example.com": http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("origin %s: status should be %d, got %d", origin, code, res.StatusCode)
+		}
+		if code == http.StatusOK && res.Header.Get("Access-Control-Allow-Origin") != origin {
+			t.Errorf("origin %s: bad Access-Control-Allow-Origin", origin)
+		}
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/engine.io/?EIO=3&transport=websocket"
+	_, res, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": []string{"http://evil.example.com"}})
+	if err == nil {
+		t.Fatal("websocket from evil origin should be rejected")
+	}
+	if res == nil || res.StatusCode != http.StatusForbidden {
+		t.Error("websocket from evil origin should be rejected with 403")
+	}
+	if eng.CountClients() != 1 {
+		t.Error("should have 1 client")
+	}
+}
+
+func newTestSocket(eng *engineImpl, transports ...TransportType) *socketImpl {
+	socket := newSocket(eng.generateID(), eng)
+	for _, it := range transports {
+		transport := newTransport(eng, it)
+		transport.setSocket(socket)
+		socket.setTransport(transport)
+	}
+	eng.sockets.Put(socket)
+	return socket
+}
+
+func TestCleanLostSocket(t *testing.T) {
+	var pingTimeout, pingInterval uint32 = 300, 100
+	eng := NewEngineBuilder().SetPingTimeout(pingTimeout).SetPingInterval(pingInterval).Build()
+	defer eng.Close()
+	impl := eng.(*engineImpl)
+
+	reasons := make(chan string, 1)
+	newTestSocket(impl, POLLING).OnClose(func(reason string) {
+		reasons <- reason
+	})
+	upgrading := newTestSocket(impl, POLLING, WEBSOCKET)
+
+	if eng.CountClients() != 2 {
+		t.Fatal("should have 2 clients")
+	}
+	select {
+	case reason := <-reasons:
+		if reason != "ping timeout" {
+			t.Error("bad close reason:", reason)
+		}
+	case <-time.After(time.Duration(pingTimeout+2*pingInterval)*time.Millisecond + 200*time.Millisecond):
+		t.Fatal("lost socket should be closed")
+	}
+	if _, ok := impl.sockets.Get(upgrading.ID()); !ok || eng.CountClients() != 1 {
+		t.Error("upgrading socket should not be closed")
+	}
+}
+
+func TestCleanUpgradingSocket(t *testing.T) {
+	var pingTimeout, pingInterval uint32 = 20, 10
+	eng := NewEngineBuilder().SetPingTimeout(pingTimeout).SetPingInterval(pingInterval).Build()
+	defer eng.Close()
+	impl := eng.(*engineImpl)
+
+	sockets := make([]*socketImpl, 0)
+	for i := 0; i < 50; i++ {
+		sockets = append(sockets, newTestSocket(impl, POLLING, WEBSOCKET))
+	}
+	// sockets are lost already but should be kept during upgrading.
+	time.Sleep(10 * time.Duration(pingTimeout+pingInterval) * time.Millisecond)
+	if eng.CountClients() != 50 {
+		t.Fatal("upgrading sockets should not be closed, got", eng.CountClients())
+	}
+	// finish upgrading while cleaner is ticking.
+	wg := new(sync.WaitGroup)
+	for _, it := range sockets {
+		wg.Add(1)
+		go func(socket *socketImpl) {
+			defer wg.Done()
+			if err := socket.accept(parser.NewPacketCustom(parser.UPGRADE, nil, 0)); err != nil {
+				t.Error(err)
+			}
+		}(it)
+	}
+	wg.Wait()
+	deadline := time.Now().Add(time.Second)
+	for eng.CountClients() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upgraded lost sockets should be closed, got", eng.CountClients())
+		}
+		time.Sleep(time.Duration(pingInterval) * time.Millisecond)
+	}
+}
+
+func TestSocketAttributes(t *testing.T) {
+	eng := NewEngineBuilder().Build()
+	defer eng.Close()
+	socket := newTestSocket(eng.(*engineImpl), POLLING)
+
+	socket.Set("uid", 42)
+	socket.Set("room", "lobby")
+	socket.Delete("room")
+	if v, ok := socket.Get("uid"); !ok || v != 42 {
+		t.Error("bad attribute uid:", v)
+	}
+	if _, ok := socket.Get("room"); ok {
+		t.Error("attribute room should be deleted")
+	}
+	if keys := socket.Keys(); len(keys) != 1 || keys[0] != "uid" {
+		t.Error("bad keys:", keys)
+	}
+	uids := make(chan interface{}, 1)
+	socket.OnClose(func(reason string) {
+		v, _ := socket.Get("uid")
+		uids <- v
+	})
+	socket.Close()
+	if v := <-uids; v != 42 {
+		t.Error("attributes should be available in close handlers")
+	}
+	// attributes are dropped after close handlers finished.
+	deadline := time.Now().Add(time.Second)
+	for len(socket.Keys()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("attributes should be dropped after socket closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	eng := NewEngineBuilder().SetPingInterval(1000).Build()
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		done <- eng.Shutdown(ctx)
+	}()
+	packets := pollingGet(t, ts.URL+"/engine.io/?EIO=3&transport=polling&sid="+msg.Sid)
+	if len(packets) != 1 || packets[0].Type != parser.CLOSE {
+		t.Error("should receive a close packet")
+	}
+	if err := <-done; err != nil {
+		t.Error("shutdown failed:", err)
+	}
+	if eng.CountClients() != 0 {
+		t.Error("should have no clients after shutdown")
+	}
+	res, err := http.Get(ts.URL + "/engine.io/?EIO=3&transport=polling")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Error("new socket should be rejected after shutdown, got", res.StatusCode)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	eng := NewEngineBuilder().Build()
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	pollingHandshake(t, ts.URL)
+	// close packet will never be polled by client.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := eng.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("shutdown should be timeout, got", err)
+	}
+	if eng.CountClients() != 0 {
+		t.Error("should have no clients after shutdown")
+	}
+}
+
+func TestPollingUpgrade(t *testing.T) {
+	eng := NewEngineBuilder().SetPingInterval(5000).Build()
+	defer eng.Close()
+	upgraded := make(chan struct{}, 1)
+	eng.OnConnect(func(socket Socket) {
+		socket.OnUpgrade(func() {
+			upgraded <- struct{}{}
+		})
+		socket.OnMessage(func(data []byte) {
+			socket.Send("[ECHO] " + string(data))
+		})
+	})
+	ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+	defer ts.Close()
+
+	msg := pollingHandshake(t, ts.URL)
+	pollingURL := ts.URL + "/engine.io/?EIO=3&transport=polling&sid=" + msg.Sid
+	// hold a GET request which should be stopped by a noop packet.
+	held := make(chan []*parser.Packet, 1)
+	go func() {
+		held <- pollingGet(t, pollingURL)
+	}()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/engine.io/?EIO=3&transport=websocket&sid=" + msg.Sid
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readWs := func() string {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, bs, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs)
+	}
+
+	// another websocket for the same sid should be rejected.
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Error("second websocket should be rejected with 400")
+	}
+
+	// probe
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("2probe")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWs(); got != "3probe" {
+		t.Fatal("should receive pong probe, got", got)
+	}
+	select {
+	case packets := <-held:
+		if len(packets) != 1 || packets[0].Type != parser.NOOP {
+			t.Error("held polling should be stopped by a noop packet")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("held polling should be stopped")
+	}
+
+	// upgrade then talk through websocket.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("4hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readWs(); got != "4[ECHO] hello" {
+		t.Error("should receive echo through websocket, got", got)
+	}
+	select {
+	case <-upgraded:
+	case <-time.After(time.Second):
+		t.Error("upgrade handler should be called")
+	}
+
+	// old polling transport has been torn down.
+	res, err := http.Get(pollingURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("late polling should be rejected with 400, got", res.StatusCode)
+	}
+	if eng.CountClients() != 1 {
+		t.Error("should have 1 client")
+	}
+}
+
+func TestShutdownDuringHandshake(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		auth    time.Duration
+		wait    time.Duration
+		byClose bool
+	}{
+		{"hook shorter than deadline", 200 * time.Millisecond, 500 * time.Millisecond, false},
+		{"hook longer than deadline", 1 * time.Second, 100 * time.Millisecond, false},
+		{"close", 1 * time.Second, 0, true},
+	} {
+		authed := make(chan struct{})
+		eng := NewEngineBuilder().OnAuthenticate(func(req *http.Request) error {
+			close(authed)
+			time.Sleep(c.auth)
+			return nil
+		}).Build()
+		ts := httptest.NewServer(http.HandlerFunc(eng.Router()))
+
+		codes := make(chan int, 1)
+		go func() {
+			res, err := http.Get(ts.URL + "/engine.io/?EIO=3&transport=polling")
+			if err != nil {
+				t.Error(err)
+				codes <- 0
+				return
+			}
+			res.Body.Close()
+			codes <- res.StatusCode
+		}()
+		<-authed
+		// neither Shutdown nor Close should wait for slow authenticate hooks.
+		start := time.Now()
+		if c.byClose {
+			eng.Close()
+		} else {
+			ctx, cancel := context.WithTimeout(context.Background(), c.wait)
+			if err := eng.Shutdown(ctx); err != nil {
+				t.Errorf("%s: shutdown failed: %s", c.name, err)
+			}
+			cancel()
+		}
+		if cost := time.Since(start); cost > c.auth/2 {
+			t.Errorf("%s: should not wait for handshake in progress, cost %s", c.name, cost)
+		}
+		if eng.CountClients() != 0 {
+			t.Errorf("%s: should have no clients after shutdown", c.name)
+		}
+		if code := <-codes; code != http.StatusServiceUnavailable {
+			t.Errorf("%s: handshake in progress should be rejected with 503, got %d", c.name, code)
+		}
+		if eng.CountClients() != 0 {
+			t.Errorf("%s: handshake in progress should not leak socket after shutdown", c.name)
+		}
+		ts.Close()
+	}
+}
@@ -19,6 +19,9 @@ func init() {
 	http.HandleFunc("/conns", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusOK)
 		writer.Write([]byte(fmt.Sprintf("totals: %d", server.CountClients())))
+		for id, socket := range server.GetClients() {
+			writer.Write([]byte(fmt.Sprintf("\n%s: %v", id, socket.Keys())))
+		}
 	})
 	var indexHtml = `
 <html>
@@ -76,6 +79,7 @@ func init() {
 
 func TestEchoServer(t *testing.T) {
 	server.OnConnect(func(socket eio.Socket) {
+		socket.Set("transport", socket.Transport().GetType())
 		socket.OnMessage(func(data []byte) {
 			socket.Send("[ECHO] " + string(data))
 		})
@@ -106,7 +106,7 @@ func (p *b64Codec) decode(data []byte) (*Packet, error) {
 		return NewPacketCustom(t, make([]byte, 0), BINARY), nil
 	}
 	if data[0] != 'b' {
-		return nil, fmt.Errorf("invalid b64 packet: %s", data)
+		return nil, errors.New("invalid b64 packet: prefix 'b' not found")
 	}
 	if t, err := convertCharToType(data[1]); err != nil {
 		return nil, err
@@ -151,7 +151,7 @@ func (p *b64Codec) encode(packet *Packet) ([]byte, error) {
 func convertCharToType(c byte) (PacketType, error) {
 	switch c {
 	default:
-		return 0xFF, fmt.Errorf("invalid packet type: %s", c)
+		return 0xFF, fmt.Errorf("invalid packet type: %c", c)
 	case '0':
 		return OPEN, nil
 	case '1':
@@ -11,8 +11,10 @@ import (
 )
 
 var (
-	errEmptyPackets = errors.New("input packets is empty")
-	jsonpReplacer   = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\u2028", "\\u2028", "\u2029", "\\u2029")
+	errEmptyPackets  = errors.New("input packets is empty")
+	errEmptyContent  = errors.New("payload content is empty")
+	errMissingLength = errors.New("read payload length failed: separator ':' not found")
+	jsonpReplacer    = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\u2028", "\\u2028", "\u2029", "\\u2029")
 )
 
 // EncodePayload encode multi packets to payload bytes.
@@ -39,6 +41,7 @@ func WritePayloadTo(writer io.Writer, jsonp bool, packets ...*Packet) error {
 }
 
 // DecodePayload decode multi packets from payload bytes.
+// An error will be returned if payload is malformed, no partial packets will be returned.
 func DecodePayload(input []byte) ([]*Packet, error) {
 	var size int
 	var err error
@@ -46,19 +49,18 @@ func DecodePayload(input []byte) ([]*Packet, error) {
 	var packets = make([]*Packet, 0)
 	var packet *Packet
 	for len(rest) > 0 {
-		if size == 0 {
-			size, rest, err = readPacketLength(rest)
-			continue
+		if size, rest, err = readPacketLength(rest); err != nil {
+			return nil, err
 		}
-		content, rest, err = readPacketString(rest, size)
-		packet, err = readPacket(content)
-		if err != nil {
+		if content, rest, err = readPacketString(rest, size); err != nil {
+			return nil, err
+		}
+		if packet, err = readPacket(content); err != nil {
 			return nil, err
 		}
 		packets = append(packets, packet)
-		size = 0
 	}
-	return packets, err
+	return packets, nil
 }
 
 // DecodePayloadString decode multi packets from payload string.
@@ -67,6 +69,9 @@ func DecodePayloadString(str string) ([]*Packet, error) {
 }
 
 func readPacket(input []byte) (*Packet, error) {
+	if len(input) < 1 {
+		return nil, errEmptyContent
+	}
 	if input[0] != 'b' {
 		return stringEncoder.decode(input)
 	}
@@ -80,20 +85,31 @@ func readPacketLength(input []byte) (int, []byte, error) {
 		}
 		size, err := strconv.Atoi(string(input[:i]))
 		if err != nil {
-			return 0, nil, err
+			// don't echo untrusted input.
+			if e, ok := err.(*strconv.NumError); ok {
+				err = e.Err
+			}
+			return 0, nil, fmt.Errorf("invalid payload length: %s", err)
+		}
+		if size < 0 {
+			return 0, nil, fmt.Errorf("invalid payload length: %d", size)
+		}
+		if size == 0 {
+			return 0, nil, errEmptyContent
 		}
 		return size, input[i+1:], nil
 	}
-	return 0, nil, fmt.Errorf("read payload length failed: %s", string(input))
+	return 0, nil, errMissingLength
 }
 
 func readPacketString(input []byte, size int) ([]byte, []byte, error) {
-	var i, w int
-	for i, w = 0, 0; i < len(input) && size > 0; {
+	var i, n int
+	for i, n = 0, 0; i < len(input) && n < size; n++ {
 		_, width := utf8.DecodeRune(input[i:])
-		w = width
-		size--
-		i += w
+		i += width
+	}
+	if n < size {
+		return nil, nil, fmt.Errorf("payload length mismatch: expect %d, actual %d", size, n)
 	}
 	return input[:i], input[i:], nil
 }
@@ -3,6 +3,7 @@ package parser
 import (
 	"bytes"
 	"log"
+	"strings"
 	"testing"
 )
 
@@ -80,3 +81,72 @@ func TestEncodeJSONP(t *testing.T) {
 	}
 	log.Println(string(bf.Bytes()))
 }
+
+func TestDecodePayloadMalformed(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{"truncated content", "7:4你好"},
+		{"truncated second packet", "1:57:4你好"},
+		{"missing content", "7:"},
+		{"missing separator", "7"},
+		{"missing length", ":4hello"},
+		{"negative length", "-1:4"},
+		{"overflowing length", "99999999999999999999:4"},
+		{"non-numeric length", "x:4"},
+		{"empty content", "0:"},
+		{"empty content before packet", "0:1:5"},
+		{"invalid packet type", "1:9"},
+		{"invalid base64 content", "4:b4%%"},
+		{"multi-byte split on boundary", "1:4你好"},
+	}
+	for _, c := range cases {
+		packets, err := DecodePayloadString(c.input)
+		if err == nil {
+			t.Errorf("%s: should fail to decode %q", c.name, c.input)
+		}
+		if packets != nil {
+			t.Errorf("%s: should not return partial packets", c.name)
+		}
+	}
+}
+
+func TestDecodePayloadErrorOmitInput(t *testing.T) {
+	secret := strings.Repeat("untrusted", 100)
+	for _, input := range []string{secret, secret + ":4", "1:" + secret} {
+		_, err := DecodePayloadString(input)
+		if err == nil {
+			t.Errorf("should fail to decode %q", input)
+		} else if strings.Contains(err.Error(), "untrusted") {
+			t.Errorf("error should not contain input: %s", err)
+		}
+	}
+}
+
+func TestDecodePayloadBoundary(t *testing.T) {
+	cases := []struct {
+		input string
+		datas []string
+	}{
+		{"2:4你", []string{"你"}},
+		{"2:4你2:4好", []string{"你", "好"}},
+		{"3:4你好1:5", []string{"你好", ""}},
+	}
+	for _, c := range cases {
+		packets, err := DecodePayloadString(c.input)
+		if err != nil {
+			t.Errorf("decode %q failed: %s", c.input, err)
+			continue
+		}
+		if len(packets) != len(c.datas) {
+			t.Errorf("decode %q: should be %d packets", c.input, len(c.datas))
+			continue
+		}
+		for i, it := range packets {
+			if string(it.Data) != c.datas[i] {
+				t.Errorf("decode %q: packet#%d should be %q", c.input, i, c.datas[i])
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package eio
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
 	"github.com/golang/glog"
@@ -10,19 +11,26 @@ import (
 )
 
 type socketImpl struct {
+	heartbeat int64 // keep first for 64-bit atomic alignment.
 	id        string
-	heartbeat uint32
 	engine    *engineImpl
 
 	msgHandlers     []func([]byte)
+	binHandlers     []func([]byte)
 	upgradeHandlers []func()
 	errorHandlers   []func(err error)
 	closeHandlers   []func(reason string)
 
+	attrs     map[string]interface{}
+	attrsLock *sync.RWMutex
+
+	transportLock                     *sync.RWMutex
 	transportBackup, transportPrimary Transport
 }
 
 func (p *socketImpl) Transport() Transport {
+	p.transportLock.RLock()
+	defer p.transportLock.RUnlock()
 	if p.transportPrimary != nil {
 		return p.transportPrimary
 	}
@@ -42,14 +50,12 @@ func (p *socketImpl) OnClose(handler func(string)) Socket {
 		return p
 	}
 	p.closeHandlers = append(p.closeHandlers, func(reason string) {
-		go func() {
-			defer func() {
-				if e := recover(); e != nil {
-					glog.Error("handle socket close event failed:", e)
-				}
-			}()
-			handler(reason)
+		defer func() {
+			if e := recover(); e != nil {
+				glog.Error("handle socket close event failed:", e)
+			}
 		}()
+		handler(reason)
 	})
 	return p
 }
@@ -58,7 +64,20 @@ func (p *socketImpl) OnMessage(handler func([]byte)) Socket {
 	if handler == nil {
 		return p
 	}
-	p.msgHandlers = append(p.msgHandlers, func(data []byte) {
+	p.msgHandlers = append(p.msgHandlers, p.wrapDataHandler(handler))
+	return p
+}
+
+func (p *socketImpl) OnBinary(handler func([]byte)) Socket {
+	if handler == nil {
+		return p
+	}
+	p.binHandlers = append(p.binHandlers, p.wrapDataHandler(handler))
+	return p
+}
+
+func (p *socketImpl) wrapDataHandler(handler func([]byte)) func([]byte) {
+	return func(data []byte) {
 		defer func() {
 			e := recover()
 			if e == nil {
@@ -76,8 +95,7 @@ func (p *socketImpl) OnMessage(handler func([]byte)) Socket {
 			glog.Errorln("handle socket message event failed:", e)
 		}()
 		handler(data)
-	})
-	return p
+	}
 }
 
 func (p *socketImpl) OnError(handler func(error)) Socket {
@@ -114,39 +132,95 @@ func (p *socketImpl) Send(message interface{}) error {
 	if !p.isHeartbeat() {
 		return fmt.Errorf("socket#%s is closed", p.id)
 	}
-	packet := parser.NewPacket(parser.MESSAGE, message)
-	if p.transportBackup != nil {
-		return p.transportBackup.write(packet)
-	}
-	return p.transportPrimary.write(packet)
+	return p.write(parser.NewPacket(parser.MESSAGE, message))
 }
 
-func (p *socketImpl) Close() {
+func (p *socketImpl) SendBinary(data []byte) error {
 	if !p.isHeartbeat() {
-		return
+		return fmt.Errorf("socket#%s is closed", p.id)
+	}
+	return p.write(parser.NewPacketCustom(parser.MESSAGE, data, parser.BINARY))
+}
+
+func (p *socketImpl) write(packet *parser.Packet) error {
+	p.transportLock.RLock()
+	t := p.transportBackup
+	if t == nil {
+		t = p.transportPrimary
 	}
+	p.transportLock.RUnlock()
+	return t.write(packet)
+}
+
+func (p *socketImpl) Close() {
+	p.close("")
+}
+
+func (p *socketImpl) close(reason string) {
 	//stop heartbeat
-	atomic.StoreUint32(&(p.heartbeat), 0)
-	var reason string
-	if p.transportPrimary != nil {
-		if err := p.transportPrimary.close(); err != nil {
-			reason += err.Error()
+	for {
+		hb := atomic.LoadInt64(&(p.heartbeat))
+		if hb == 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&(p.heartbeat), hb, 0) {
+			break
 		}
 	}
-	if p.transportBackup != nil {
-		if err := p.transportBackup.close(); err != nil {
+	p.engine.sockets.Remove(p)
+	for _, it := range p.getTransports() {
+		if err := it.close(); err != nil {
 			if len(reason) > 0 {
 				reason += ", "
 			}
 			reason += err.Error()
 		}
 	}
-	for _, fn := range p.closeHandlers {
-		fn(reason)
+	go func() {
+		for _, fn := range p.closeHandlers {
+			fn(reason)
+		}
+		// attributes are available in close handlers, drop them at last.
+		p.attrsLock.Lock()
+		p.attrs = nil
+		p.attrsLock.Unlock()
+	}()
+}
+
+func (p *socketImpl) Set(key string, value interface{}) {
+	p.attrsLock.Lock()
+	if p.attrs != nil {
+		p.attrs[key] = value
 	}
+	p.attrsLock.Unlock()
+}
+
+func (p *socketImpl) Get(key string) (interface{}, bool) {
+	p.attrsLock.RLock()
+	defer p.attrsLock.RUnlock()
+	value, ok := p.attrs[key]
+	return value, ok
+}
+
+func (p *socketImpl) Delete(key string) {
+	p.attrsLock.Lock()
+	delete(p.attrs, key)
+	p.attrsLock.Unlock()
+}
+
+func (p *socketImpl) Keys() []string {
+	p.attrsLock.RLock()
+	defer p.attrsLock.RUnlock()
+	keys := make([]string, 0, len(p.attrs))
+	for k := range p.attrs {
+		keys = append(keys, k)
+	}
+	return keys
 }
 
 func (p *socketImpl) setTransport(t Transport) error {
+	p.transportLock.Lock()
+	defer p.transportLock.Unlock()
 	if p.transportPrimary != nil {
 		return errors.New("transports is full")
 	}
@@ -159,6 +233,8 @@ func (p *socketImpl) setTransport(t Transport) error {
 }
 
 func (p *socketImpl) getTransport() Transport {
+	p.transportLock.RLock()
+	defer p.transportLock.RUnlock()
 	if p.transportPrimary != nil {
 		return p.transportPrimary
 	} else if p.transportBackup != nil {
@@ -168,11 +244,50 @@ func (p *socketImpl) getTransport() Transport {
 	}
 }
 
-func (p *socketImpl) getTransportBackup() Transport {
+// tryTransportBackup returns the old transport if socket is upgrading.
+func (p *socketImpl) tryTransportBackup() (Transport, bool) {
+	p.transportLock.RLock()
+	defer p.transportLock.RUnlock()
 	if p.transportPrimary == nil || p.transportBackup == nil {
-		panic("old transport unavailable")
+		return nil, false
 	}
-	return p.transportBackup
+	return p.transportBackup, true
+}
+
+// getTransports returns all available transports, backup transport first.
+func (p *socketImpl) getTransports() []Transport {
+	p.transportLock.RLock()
+	defer p.transportLock.RUnlock()
+	ret := make([]Transport, 0, 2)
+	for _, it := range []Transport{p.transportBackup, p.transportPrimary} {
+		if it != nil {
+			ret = append(ret, it)
+		}
+	}
+	return ret
+}
+
+func (p *socketImpl) isUpgrading() bool {
+	p.transportLock.RLock()
+	defer p.transportLock.RUnlock()
+	return p.transportPrimary != nil && p.transportBackup != nil
+}
+
+// finishUpgrade move rest packets to primary transport then close backup transport.
+func (p *socketImpl) finishUpgrade() error {
+	p.transportLock.RLock()
+	tBackup, tPrimary := p.transportBackup, p.transportPrimary
+	p.transportLock.RUnlock()
+	if tBackup == nil || tPrimary == nil {
+		return nil
+	}
+	tBackup.upgradeEnd(tPrimary)
+	p.transportLock.Lock()
+	p.transportBackup = nil
+	p.transportLock.Unlock()
+	// move packets written during switching.
+	tBackup.upgradeEnd(tPrimary)
+	return tBackup.close()
 }
 
 func (p *socketImpl) accept(packet *parser.Packet) error {
@@ -183,13 +298,8 @@ func (p *socketImpl) accept(packet *parser.Packet) error {
 		p.Close()
 		break
 	case parser.UPGRADE:
-		if p.transportPrimary != nil && p.transportBackup != nil {
-			tBackup := p.transportBackup
-			tBackup.upgradeEnd(p.transportPrimary)
-			p.transportBackup = nil
-			if err := tBackup.close(); err != nil {
-				return err
-			}
+		if err := p.finishUpgrade(); err != nil {
+			return err
 		}
 		for _, fn := range p.upgradeHandlers {
 			fn()
@@ -199,15 +309,20 @@ func (p *socketImpl) accept(packet *parser.Packet) error {
 		//response PING in async as this action is not relate business.
 		go func() {
 			// refresh heartbeat then pong it.
-			if p.isHeartbeat() {
-				atomic.StoreUint32(&(p.heartbeat), now32())
+			if hb := atomic.LoadInt64(&(p.heartbeat)); hb != 0 {
+				atomic.CompareAndSwapInt64(&(p.heartbeat), hb, nowMillis())
 			}
 			pong := parser.NewPacketCustom(parser.PONG, packet.Data, 0)
 			p.getTransport().write(pong)
 		}()
 		break
 	case parser.MESSAGE:
-		for _, fn := range p.msgHandlers {
+		handlers := p.msgHandlers
+		// binary packets fallback to message handlers if no binary handler exists.
+		if packet.Option&parser.BINARY == parser.BINARY && len(p.binHandlers) > 0 {
+			handlers = p.binHandlers
+		}
+		for _, fn := range handlers {
 			fn(packet.Data)
 		}
 		break
@@ -216,22 +331,36 @@ func (p *socketImpl) accept(packet *parser.Packet) error {
 }
 
 func (p *socketImpl) isHeartbeat() bool {
-	return atomic.LoadUint32(&(p.heartbeat)) == 0
+	return atomic.LoadInt64(&(p.heartbeat)) != 0
+}
+
+func (p *socketImpl) isDrained() bool {
+	for _, it := range p.getTransports() {
+		if it.pending() > 0 {
+			return false
+		}
+	}
+	return true
 }
 
+// isLost returns true if no ping received in pingInterval + pingTimeout.
 func (p *socketImpl) isLost() bool {
-	d := 1000 * (now32() - atomic.LoadUint32(&(p.heartbeat)))
-	return d > p.engine.options.pingTimeout
+	d := nowMillis() - atomic.LoadInt64(&(p.heartbeat))
+	return d > int64(p.engine.options.pingInterval)+int64(p.engine.options.pingTimeout)
 }
 
 func newSocket(id string, eng *engineImpl) *socketImpl {
 	socket := &socketImpl{
 		id:              id,
 		engine:          eng,
-		heartbeat:       now32(),
+		heartbeat:       nowMillis(),
 		upgradeHandlers: make([]func(), 0),
 		msgHandlers:     make([]func([]byte), 0),
+		binHandlers:     make([]func([]byte), 0),
 		errorHandlers:   make([]func(error), 0),
+		attrs:           make(map[string]interface{}),
+		attrsLock:       new(sync.RWMutex),
+		transportLock:   new(sync.RWMutex),
 	}
 	return socket
 }
@@ -7,6 +7,11 @@ import (
 	"github.com/golang/glog"
 )
 
+const (
+	transportPolling   = "polling"
+	transportWebsocket = "websocket"
+)
+
 type messageOK struct {
 	Sid          string   `json:"sid"`
 	Upgrades     []string `json:"upgrades"`
@@ -10,19 +10,15 @@ import (
 	"github.com/jjeffcaii/engine.io/parser"
 )
 
-var (
-	libWebsocket          *websocket.Upgrader
-	errUpgradeWsTransport error
-)
+var errUpgradeWsTransport = errors.New("transport: cannot upgrade websocket transport")
 
-func init() {
-	libWebsocket = &websocket.Upgrader{
-		CheckOrigin:       func(r *http.Request) bool { return true },
+func newWebsocketUpgrader(checkOrigin func(*http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin:       checkOrigin,
 		ReadBufferSize:    1024,
 		WriteBufferSize:   1024,
 		EnableCompression: true,
 	}
-	errUpgradeWsTransport = errors.New("transport: cannot upgrade websocket transport")
 }
 
 type wsTransport struct {
@@ -53,7 +49,7 @@ func (p *wsTransport) ensureWebsocket(writer http.ResponseWriter, request *http.
 		return nil
 	}
 	// upgrade to websocket.
-	conn, err := libWebsocket.Upgrade(writer, request, nil)
+	conn, err := p.eng.upgrader.Upgrade(writer, request, nil)
 	if err != nil {
 		glog.Errorln("websocket upgrade failed:", err)
 		return err
@@ -166,7 +162,9 @@ func (p *wsTransport) flush() error {
 			return err
 		}
 		if out.Type == parser.PONG && out.Data != nil && len(out.Data) == 5 && string(out.Data[:5]) == "probe" {
-			p.socket.getTransportBackup().upgradeStart()
+			if tBackup, ok := p.socket.tryTransportBackup(); ok {
+				tBackup.upgradeStart()
+			}
 		}
 	}
 	if p.handlerFlush != nil {
@@ -182,6 +180,10 @@ func (p *wsTransport) close() error {
 	return p.connect.Close()
 }
 
+func (p *wsTransport) pending() int {
+	return p.outbox.size()
+}
+
 func newWebsocketTransport(eng *engineImpl) Transport {
 	t := &wsTransport{
 		tinyTransport: tinyTransport{
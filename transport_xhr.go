@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -20,15 +21,19 @@ const (
 var (
 	errHTTPMethod      = errors.New("transport: illegal http method")
 	errPollingEOF      = errors.New("transport: polling EOF")
+	errPollingOverlap  = errors.New("transport: overlap from client")
 	defaultPacketClose = parser.NewPacketCustom(parser.CLOSE, nil, 0)
+	defaultPacketNoop  = parser.NewPacketCustom(parser.NOOP, nil, 0)
 	jsonpEnd           = []byte("\");")
 )
 
 type xhrTransport struct {
 	tinyTransport
-	outbox chan *parser.Packet
-	req    *http.Request
-	res    http.ResponseWriter
+	outbox   chan *parser.Packet
+	req      *http.Request
+	res      http.ResponseWriter
+	polling  int32 // 1 when a GET request is holding current transport.
+	upgraded int32 // 1 when all packets have been moved to the upgraded transport.
 }
 
 func (p *xhrTransport) GetRequest() *http.Request {
@@ -68,8 +73,12 @@ func (p *xhrTransport) init(writer http.ResponseWriter, request *http.Request) e
 	}
 	if p.eng.options.allowUpgrades {
 		for _, it := range p.eng.allowTransports {
-			if it == WEBSOCKET {
-				okMsg.Upgrades = append(okMsg.Upgrades, "websocket")
+			switch it {
+			case POLLING:
+				okMsg.Upgrades = append(okMsg.Upgrades, transportPolling)
+				break
+			case WEBSOCKET:
+				okMsg.Upgrades = append(okMsg.Upgrades, transportWebsocket)
 				break
 			}
 		}
@@ -87,13 +96,7 @@ func (p *xhrTransport) receive(writer http.ResponseWriter, request *http.Request
 		}
 		writer.Header().Set("Set-Cookie", cookie)
 	}
-	origin := request.Header.Get("Origin")
-	if len(origin) > 0 {
-		writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		writer.Header().Set("Access-Control-Allow-Origin", origin)
-	} else {
-		writer.Header().Set("Access-Control-Allow-Origin", "*")
-	}
+	setAllowOrigin(writer, request)
 	switch request.Method {
 	default:
 		break
@@ -106,12 +109,29 @@ func (p *xhrTransport) receive(writer http.ResponseWriter, request *http.Request
 	}
 }
 
+// setAllowOrigin write CORS headers, origin of request should be checked before.
+func setAllowOrigin(writer http.ResponseWriter, request *http.Request) {
+	origin := request.Header.Get("Origin")
+	if len(origin) > 0 {
+		writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+	} else {
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+}
+
 func (p *xhrTransport) receiveGetReq(writer http.ResponseWriter, request *http.Request) {
+	// only one GET request can be held for each sid.
+	if !atomic.CompareAndSwapInt32(&(p.polling), 0, 1) {
+		sendError(writer, errPollingOverlap, http.StatusBadRequest)
+		return
+	}
 	p.req = request
 	p.res = writer
 	defer func() {
 		p.req = nil
 		p.res = nil
+		atomic.StoreInt32(&(p.polling), 0)
 	}()
 	j, jsonp := p.tryJSONP()
 	if jsonp {
@@ -121,7 +141,13 @@ func (p *xhrTransport) receiveGetReq(writer http.ResponseWriter, request *http.R
 		}
 	}
 	var kill bool
-	if err := p.flush(); err == errPollingEOF {
+	if err := p.flush(); err == errPollingEOF && atomic.LoadInt32(&(p.upgraded)) == 1 {
+		// socket has been upgraded, just stop polling of client.
+		if err := parser.WritePayloadTo(p.res, false, defaultPacketNoop); err != nil {
+			glog.Errorln("write noop packet failed:", err)
+			return
+		}
+	} else if err == errPollingEOF {
 		kill = true
 		if err := parser.WritePayloadTo(p.res, false, defaultPacketClose); err != nil {
 			glog.Errorln("write close packet failed:", err)
@@ -136,18 +162,18 @@ func (p *xhrTransport) receiveGetReq(writer http.ResponseWriter, request *http.R
 	}
 	if kill {
 		p.socket.Close()
-		p.socket = nil
 	}
 }
 func (p *xhrTransport) receivePostReq(writer http.ResponseWriter, request *http.Request) {
 	var err error
+	code := http.StatusInternalServerError
 	defer func() {
 		request.Body.Close()
 		if err == nil {
 			writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
 			writer.Write([]byte("ok"))
 		} else {
-			sendError(writer, err, http.StatusInternalServerError)
+			sendError(writer, err, code)
 		}
 	}()
 	// read body
@@ -161,7 +187,7 @@ func (p *xhrTransport) receivePostReq(writer http.ResponseWriter, request *http.
 		}
 		break
 	case "application/x-www-form-urlencoded":
-		if err := request.ParseForm(); err != nil {
+		if err = request.ParseForm(); err != nil {
 			glog.Errorln("parse post form failed:", err)
 			return
 		}
@@ -172,13 +198,16 @@ func (p *xhrTransport) receivePostReq(writer http.ResponseWriter, request *http.
 	var packets []*parser.Packet
 	packets, err = parser.DecodePayload(body)
 	if err != nil {
+		// malformed payload from client.
+		code = http.StatusBadRequest
 		return
 	}
 	// notify socket
+	socket := p.socket
 	go func() {
 		for _, pack := range packets {
-			err = p.socket.accept(pack)
-			if err != nil {
+			if err := socket.accept(pack); err != nil {
+				glog.Errorln("accept packet failed:", err)
 				return
 			}
 		}
@@ -195,7 +224,10 @@ func (p *xhrTransport) upgradeEnd(tActive Transport) error {
 	for {
 		select {
 		case pk := <-p.outbox:
-			if pk != nil {
+			if pk == nil {
+				// outbox has been closed.
+				end = true
+			} else {
 				tActive.write(pk)
 			}
 			break
@@ -207,6 +239,7 @@ func (p *xhrTransport) upgradeEnd(tActive Transport) error {
 			break
 		}
 	}
+	atomic.StoreInt32(&(p.upgraded), 1)
 	return nil
 }
 
@@ -224,6 +257,9 @@ func (p *xhrTransport) write(packet *parser.Packet) error {
 		}()
 		p.outbox <- packet
 	}()
+	if err != nil {
+		return err
+	}
 	if p.handlerWrite != nil {
 		p.handlerWrite()
 	}
@@ -254,7 +290,8 @@ func (p *xhrTransport) flush() error {
 			break
 		}
 	}
-	// 2. waiting packet inbox chan until timeout if queue is empty.
+	_, jsonp := p.tryJSONP()
+	// 2. waiting packet inbox chan until ping interval if queue is empty.
 	if len(queue) < 1 {
 		select {
 		case <-closeNotifier.CloseNotify():
@@ -266,12 +303,11 @@ func (p *xhrTransport) flush() error {
 			}
 			queue = append(queue, pk)
 			break
-		case <-time.After(time.Millisecond * time.Duration(p.eng.options.pingTimeout)):
-			return errPollingEOF
-			//queue = append(queue, parser.NewPacketCustom(parser.CLOSE, make([]byte, 0), 0))
+		case <-time.After(time.Millisecond * time.Duration(p.eng.options.pingInterval)):
+			// nothing to send, finish this poll cycle with a noop packet.
+			return parser.WritePayloadTo(p.res, jsonp, defaultPacketNoop)
 		}
 	}
-	_, jsonp := p.tryJSONP()
 	if len(queue) == 1 {
 		if queue[0].Type == parser.NOOP {
 			time.Sleep(noopDelay)
@@ -306,6 +342,10 @@ func (p *xhrTransport) close() error {
 	return err
 }
 
+func (p *xhrTransport) pending() int {
+	return len(p.outbox)
+}
+
 func newXhrTransport(server *engineImpl) Transport {
 	trans := xhrTransport{
 		tinyTransport: tinyTransport{
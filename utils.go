@@ -57,8 +57,8 @@ func randomSessionID(seed uint32) string {
 	return s
 }
 
-func now32() uint32 {
-	return uint32(time.Now().Unix())
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
 type queue struct {